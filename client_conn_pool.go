@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/http2"
 )
@@ -15,17 +17,18 @@ import (
 const NextProtoTLS = "h2"
 
 type clientConnPool struct {
-	t      *Transport
-	mtx    sync.Mutex
-	groups map[string]*clientConnGroup
-	keys   map[*http2.ClientConn]string
+	t       *Transport
+	mtx     sync.Mutex
+	groups  map[string]*clientConnGroup
+	keys    map[*http2.ClientConn]string
+	reqConn sync.Map // *http.Request -> *http2.ClientConn, for quarantine
 
 	maxConnsPerHost int
 }
 
 func (p *clientConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
 	if p.t.DisableKeepAlives {
-		return dialClientConn(p.t.Transport, req.Context(), addr)
+		return dialClientConn(p.t, req, addr)
 	}
 	p.mtx.Lock()
 	g, ok := p.groups[addr]
@@ -38,7 +41,98 @@ func (p *clientConnPool) GetClientConn(req *http.Request, addr string) (*http2.C
 		p.groups[addr] = g
 	}
 	p.mtx.Unlock()
-	return g.getClientConn(req)
+	conn, err := g.getClientConn(req)
+	if err == nil {
+		p.reqConn.Store(req, conn)
+		if cb := p.t.OnConnAcquired; cb != nil {
+			cb(addr, conn)
+		}
+	}
+	return conn, err
+}
+
+// lookupAddr reports the address conn was dialed for, if it is still
+// tracked by the pool.
+func (p *clientConnPool) lookupAddr(conn *http2.ClientConn) (string, bool) {
+	p.mtx.Lock()
+	addr, ok := p.keys[conn]
+	p.mtx.Unlock()
+	return addr, ok
+}
+
+// forget drops the bookkeeping entry used to quarantine req's connection
+// on failure, marks it as just having gone idle for the reaper's benefit,
+// and wakes any caller waiting for capacity to free up. It is called once
+// a RoundTrip attempt succeeds, or fails with an error that is not
+// retryable.
+func (p *clientConnPool) forget(req *http.Request) {
+	v, ok := p.reqConn.Load(req)
+	if !ok {
+		return
+	}
+	p.reqConn.Delete(req)
+	conn := v.(*http2.ClientConn)
+	addr, ok := p.lookupAddr(conn)
+	if !ok {
+		return
+	}
+	if cb := p.t.OnConnReleased; cb != nil {
+		cb(addr, conn)
+	}
+	p.mtx.Lock()
+	g := p.groups[addr]
+	p.mtx.Unlock()
+	if g == nil {
+		return
+	}
+	g.mtx.Lock()
+	g.touch(conn)
+	g.broadcastRelease()
+	g.mtx.Unlock()
+}
+
+// quarantine marks the connection last handed out for req as doNotReuse,
+// so the group stops offering it to other callers even before MarkDead
+// fires for it. It is called after a RoundTrip attempt fails with a
+// retryable error.
+func (p *clientConnPool) quarantine(req *http.Request) {
+	v, ok := p.reqConn.Load(req)
+	if !ok {
+		return
+	}
+	p.reqConn.Delete(req)
+	conn := v.(*http2.ClientConn)
+	addr, ok := p.lookupAddr(conn)
+	if !ok {
+		return
+	}
+	if cb := p.t.OnConnReleased; cb != nil {
+		cb(addr, conn)
+	}
+	p.mtx.Lock()
+	g := p.groups[addr]
+	p.mtx.Unlock()
+	if g == nil {
+		return
+	}
+	g.mtx.Lock()
+	if g.dead == nil {
+		g.dead = make(map[*http2.ClientConn]bool)
+	}
+	g.dead[conn] = true
+	g.touch(conn)
+	g.broadcastRelease()
+	g.mtx.Unlock()
+}
+
+// incrRetry counts one RoundTrip retry against addr's host stats.
+func (p *clientConnPool) incrRetry(addr string) {
+	p.mtx.Lock()
+	g := p.groups[addr]
+	p.mtx.Unlock()
+	if g != nil {
+		atomic.AddInt64(&g.retries, 1)
+	}
 }
 
 func (p *clientConnPool) MarkDead(conn *http2.ClientConn) {
@@ -55,78 +149,311 @@ func (p *clientConnPool) MarkDead(conn *http2.ClientConn) {
 		return
 	}
 	p.mtx.Unlock()
+	atomic.AddInt64(&g.deadCount, 1)
+	if cb := p.t.OnConnMarkedDead; cb != nil {
+		cb(addr, conn)
+	}
 	g.mtx.Lock()
 	g.removeClientConn(conn)
-	if len(g.conns) == 0 {
+	empty := len(g.conns) == 0
+	g.broadcastRelease()
+	g.mtx.Unlock()
+	if empty {
 		p.mtx.Lock()
 		delete(p.groups, addr)
 		p.mtx.Unlock()
+		g.stopReaper()
+	}
+}
+
+// stats builds a point-in-time HostStats snapshot for every address with
+// an active group.
+func (p *clientConnPool) stats() map[string]HostStats {
+	p.mtx.Lock()
+	groups := make(map[string]*clientConnGroup, len(p.groups))
+	for addr, g := range p.groups {
+		groups[addr] = g
+	}
+	p.mtx.Unlock()
+	out := make(map[string]HostStats, len(groups))
+	for addr, g := range groups {
+		out[addr] = g.stats()
+	}
+	return out
+}
+
+// closeIdleConnections closes every connection, across all groups, that
+// currently has no active streams.
+func (p *clientConnPool) closeIdleConnections() {
+	p.mtx.Lock()
+	groups := make([]*clientConnGroup, 0, len(p.groups))
+	for _, g := range p.groups {
+		groups = append(groups, g)
+	}
+	p.mtx.Unlock()
+	for _, g := range groups {
+		g.mtx.Lock()
+		idle := make([]*http2.ClientConn, 0, len(g.conns))
+		for _, conn := range g.conns {
+			if conn.State().StreamsActive == 0 {
+				idle = append(idle, conn)
+			}
+		}
+		g.mtx.Unlock()
+		for _, conn := range idle {
+			conn.Close()
+			p.MarkDead(conn)
+		}
 	}
-	g.mtx.Unlock()
 }
 
 type clientConnGroup struct {
-	p       *clientConnPool
-	addr    string
-	connIdx int
-	mtx     sync.Mutex
-	conns   []*http2.ClientConn
-	keys    map[*http2.ClientConn]int
-	dialing int32
+	p        *clientConnPool
+	addr     string
+	mtx      sync.Mutex
+	conns    []*http2.ClientConn
+	keys     map[*http2.ClientConn]int
+	dead     map[*http2.ClientConn]bool      // doNotReuse: quarantined, pending MarkDead
+	lastUsed map[*http2.ClientConn]time.Time // last time each conn was handed out
+
+	reaping  bool
+	stopReap chan struct{}
+
+	dialCh   chan struct{} // non-nil while a dial is in flight; closed on completion
+	dialConn *http2.ClientConn
+	dialErr  error
+
+	released chan struct{} // non-nil while a caller is waiting for capacity; closed to wake them
+
+	dialing    int32 // atomic: dials currently in flight
+	dialErrors int64 // atomic: cumulative dial failures
+	deadCount  int64 // atomic: cumulative MarkDead calls
+	retries    int64 // atomic: cumulative RoundTrip retries
+	waitTimes  WaitTimeHistogram
 }
 
+// stats reports a point-in-time snapshot of this group's counters.
+func (g *clientConnGroup) stats() HostStats {
+	g.mtx.Lock()
+	streamsActive := 0
+	for _, conn := range g.conns {
+		streamsActive += conn.State().StreamsActive
+	}
+	hs := HostStats{
+		ConnsOpen:     len(g.conns),
+		ConnsDialing:  int(atomic.LoadInt32(&g.dialing)),
+		ConnsDead:     atomic.LoadInt64(&g.deadCount),
+		StreamsActive: streamsActive,
+		DialErrors:    atomic.LoadInt64(&g.dialErrors),
+		Retries:       atomic.LoadInt64(&g.retries),
+		WaitTimes: WaitTimeHistogram{
+			Under1ms:   atomic.LoadInt64(&g.waitTimes.Under1ms),
+			Under10ms:  atomic.LoadInt64(&g.waitTimes.Under10ms),
+			Under100ms: atomic.LoadInt64(&g.waitTimes.Under100ms),
+			Under1s:    atomic.LoadInt64(&g.waitTimes.Under1s),
+			Over1s:     atomic.LoadInt64(&g.waitTimes.Over1s),
+		},
+	}
+	g.mtx.Unlock()
+	return hs
+}
+
+// getClientConn returns a connection that can take req now, picking the
+// least-loaded existing connection when its load is below the high-water
+// mark. If the least-loaded connection can still take req but is at or
+// above that mark, it is returned anyway, after a background pre-dial is
+// started if there's still room to grow. If there are no connections yet,
+// or none can take req and there's still room to grow, it joins (or
+// starts) an in-flight dial and waits for it. If the group is already at
+// MaxConnsPerHost and every connection is saturated, it instead waits for
+// some in-flight request to release a connection and re-evaluates from
+// scratch — bounded by req's context throughout, mirroring
+// http.Transport's queueForIdleConn/queueForDial model instead of
+// returning a spurious error while capacity is merely busy, not absent.
 func (g *clientConnGroup) getClientConn(req *http.Request) (*http2.ClientConn, error) {
 	g.mtx.Lock()
-	defer g.mtx.Unlock()
-	if len(g.conns) == 0 {
-		conn, err := dialClientConn(g.p.t.Transport, req.Context(), g.addr)
-		if err != nil {
-			return nil, err
-		}
-		g.p.mtx.Lock()
-		g.addClientConn(conn)
-		g.p.mtx.Unlock()
-		return conn, nil
-	} else if g.p.maxConnsPerHost <= 0 || g.p.maxConnsPerHost > len(g.conns) {
-		go g.dialClientConn(req)
-	}
-	for retry := 0; retry < len(g.conns); retry++ {
-		g.connIdx++
-		conn := g.conns[g.connIdx%len(g.conns)]
-		if conn.CanTakeNewRequest() {
+	for {
+		if len(g.conns) == 0 {
+			ch := g.dialCh
+			if ch == nil {
+				ch = g.startDial(req)
+			}
+			g.mtx.Unlock()
+			return g.waitForDial(req, ch)
+		}
+		atCapacity := g.p.maxConnsPerHost > 0 && g.p.maxConnsPerHost <= len(g.conns)
+		conn, ratio := g.pickConn(req)
+		if conn != nil && ratio < g.highWaterMarkRatio() {
+			g.touch(conn)
+			g.mtx.Unlock()
 			return conn, nil
 		}
+		// Existing conns are approaching or at capacity: keep at most one
+		// pre-dial in flight, started only while there's still room to grow.
+		if !atCapacity && g.dialCh == nil {
+			g.startDial(req)
+		}
+		if conn != nil {
+			g.touch(conn)
+			g.mtx.Unlock()
+			return conn, nil
+		}
+		if !atCapacity {
+			ch := g.dialCh
+			g.mtx.Unlock()
+			return g.waitForDial(req, ch)
+		}
+		// At capacity and every connection is saturated: wait for some
+		// in-flight request on this host to release its connection, then
+		// loop around and re-evaluate.
+		relCh := g.releaseChan()
+		g.mtx.Unlock()
+		waitStart := time.Now()
+		select {
+		case <-relCh:
+			g.waitTimes.observe(time.Since(waitStart))
+			g.mtx.Lock()
+		case <-req.Context().Done():
+			g.waitTimes.observe(time.Since(waitStart))
+			return nil, req.Context().Err()
+		}
 	}
-	return nil, fmt.Errorf("no available connection to %s", g.addr)
 }
 
-func (g *clientConnGroup) dialClientConn(req *http.Request) {
-	if !atomic.CompareAndSwapInt32(&g.dialing, 0, 1) {
-		return
+// startDial begins dialing a new connection in the background and
+// returns the channel that will be closed when it completes. Callers
+// must hold g.mtx; the background dial locks g.mtx itself once it has
+// finished dialing.
+func (g *clientConnGroup) startDial(req *http.Request) chan struct{} {
+	ch := make(chan struct{})
+	g.dialCh = ch
+	atomic.AddInt32(&g.dialing, 1)
+	if cb := g.p.t.OnDialStart; cb != nil {
+		cb(g.addr)
 	}
-	defer atomic.StoreInt32(&g.dialing, 0)
-	g.mtx.Lock()
-	if len(g.conns) >= g.p.maxConnsPerHost {
+	go func() {
+		conn, err := dialClientConn(g.p.t, req, g.addr)
+		atomic.AddInt32(&g.dialing, -1)
+		if err != nil {
+			atomic.AddInt64(&g.dialErrors, 1)
+		}
+		if cb := g.p.t.OnDialDone; cb != nil {
+			cb(g.addr, err)
+		}
+		g.mtx.Lock()
+		g.dialConn, g.dialErr = conn, err
+		if err == nil {
+			g.p.mtx.Lock()
+			g.addClientConn(conn)
+			g.p.mtx.Unlock()
+			g.touch(conn)
+		}
+		g.dialCh = nil
 		g.mtx.Unlock()
-		return
+		close(ch)
+	}()
+	return ch
+}
+
+// waitForDial blocks until the dial behind ch completes or req's context
+// is done, whichever comes first, recording how long the caller waited.
+func (g *clientConnGroup) waitForDial(req *http.Request, ch chan struct{}) (*http2.ClientConn, error) {
+	start := time.Now()
+	defer func() { g.waitTimes.observe(time.Since(start)) }()
+	select {
+	case <-ch:
+		g.mtx.Lock()
+		conn, err := g.dialConn, g.dialErr
+		g.mtx.Unlock()
+		return conn, err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
 	}
-	g.mtx.Unlock()
-	conn, err := dialClientConn(g.p.t.Transport, req.Context(), g.addr)
-	if err != nil {
-		fmt.Printf("error dialing '%s': %s", g.addr, err)
-		return
+}
+
+// touch records conn as just having been handed out or released back to
+// the group, for the idle reaper's benefit — reapIdle only considers the
+// time since the most recent of those, so a connection held for a single
+// long-running request isn't reaped on the very next tick after it
+// finishes. Callers must hold g.mtx.
+func (g *clientConnGroup) touch(conn *http2.ClientConn) {
+	if g.lastUsed == nil {
+		g.lastUsed = make(map[*http2.ClientConn]time.Time)
 	}
-	g.mtx.Lock()
-	g.p.mtx.Lock()
-	g.addClientConn(conn)
-	g.p.mtx.Unlock()
-	g.mtx.Unlock()
+	g.lastUsed[conn] = time.Now()
 }
 
+// pickConn selects a usable connection for req, preferring the one with
+// the most free stream slots, or g.p.t.PickConn's choice if set. It also
+// reports that connection's stream load ratio (0 meaning idle, 1 meaning
+// at its MaxConcurrentStreams).
+func (g *clientConnGroup) pickConn(req *http.Request) (*http2.ClientConn, float64) {
+	var usable []*http2.ClientConn
+	for _, conn := range g.conns {
+		if conn.CanTakeNewRequest() && !g.dead[conn] {
+			usable = append(usable, conn)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, 0
+	}
+	if pick := g.p.t.PickConn; pick != nil {
+		if conn := pick(usable, req); conn != nil {
+			return conn, connLoadRatio(conn)
+		}
+	}
+	best, bestRatio := usable[0], connLoadRatio(usable[0])
+	for _, conn := range usable[1:] {
+		if ratio := connLoadRatio(conn); ratio < bestRatio {
+			best, bestRatio = conn, ratio
+		}
+	}
+	return best, bestRatio
+}
+
+// connLoadRatio reports conn's active+reserved streams as a fraction of
+// its MaxConcurrentStreams.
+func connLoadRatio(conn *http2.ClientConn) float64 {
+	state := conn.State()
+	if state.MaxConcurrentStreams == 0 {
+		return 0
+	}
+	return float64(state.StreamsActive+state.StreamsReserved) / float64(state.MaxConcurrentStreams)
+}
+
+// releaseChan returns the channel that will be closed the next time a
+// request releases a connection back to the group, for a caller in
+// getClientConn waiting on capacity to free up. Callers must hold g.mtx.
+func (g *clientConnGroup) releaseChan() chan struct{} {
+	if g.released == nil {
+		g.released = make(chan struct{})
+	}
+	return g.released
+}
+
+// broadcastRelease wakes any caller parked in getClientConn waiting for
+// capacity to free up. Callers must hold g.mtx.
+func (g *clientConnGroup) broadcastRelease() {
+	if g.released != nil {
+		close(g.released)
+		g.released = nil
+	}
+}
+
+func (g *clientConnGroup) highWaterMarkRatio() float64 {
+	if r := g.p.t.HighWaterMarkRatio; r > 0 {
+		return r
+	}
+	return 0.8
+}
+
+// addClientConn registers conn with the group and, if IdleConnTimeout is
+// set, lazily starts the group's idle reaper. Callers must hold g.mtx.
 func (g *clientConnGroup) addClientConn(conn *http2.ClientConn) {
 	g.keys[conn] = len(g.conns)
 	g.conns = append(g.conns, conn)
 	g.p.keys[conn] = g.addr
+	g.maybeStartReaper()
 }
 
 func (g *clientConnGroup) removeClientConn(conn *http2.ClientConn) {
@@ -141,31 +468,131 @@ func (g *clientConnGroup) removeClientConn(conn *http2.ClientConn) {
 			delete(g.keys, conn)
 		}
 	}
+	delete(g.dead, conn)
+	delete(g.lastUsed, conn)
+}
+
+// maybeStartReaper lazily starts the group's idle-connection reaper the
+// first time a conn is added, if IdleConnTimeout is configured. Callers
+// must hold g.mtx.
+func (g *clientConnGroup) maybeStartReaper() {
+	if g.reaping || g.p.t.IdleConnTimeout <= 0 {
+		return
+	}
+	g.reaping = true
+	g.stopReap = make(chan struct{})
+	go g.reap(g.p.t.IdleConnTimeout, g.stopReap)
+}
+
+// stopReaper stops the group's idle reaper, if running. It is called
+// once the group's connection list becomes empty.
+func (g *clientConnGroup) stopReaper() {
+	g.mtx.Lock()
+	if g.reaping {
+		close(g.stopReap)
+		g.reaping = false
+	}
+	g.mtx.Unlock()
+}
+
+// reap periodically closes and evicts connections that have been idle
+// (no active streams) for longer than timeout, until stop is closed.
+func (g *clientConnGroup) reap(timeout time.Duration, stop chan struct{}) {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			g.reapIdle(timeout)
+		}
+	}
+}
+
+func (g *clientConnGroup) reapIdle(timeout time.Duration) {
+	g.mtx.Lock()
+	now := time.Now()
+	var idle []*http2.ClientConn
+	for _, conn := range g.conns {
+		if conn.State().StreamsActive == 0 && now.Sub(g.lastUsed[conn]) >= timeout {
+			idle = append(idle, conn)
+		}
+	}
+	g.mtx.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+		g.p.MarkDead(conn)
+	}
 }
 
-func dialClientConn(t *http2.Transport, ctx context.Context, addr string) (*http2.ClientConn, error) {
+// dialClientConn dials addr and wraps it in a *http2.ClientConn, honoring
+// any httptrace.ClientTrace attached to req's context.
+func dialClientConn(pt *Transport, req *http.Request, addr string) (*http2.ClientConn, error) {
+	ctx := req.Context()
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.GetConn != nil {
+		trace.GetConn(addr)
+	}
+	var conn net.Conn
+	var err error
+	if req.URL != nil && req.URL.Scheme == "http" {
+		conn, err = dialH2CConn(pt, ctx, trace, addr)
+	} else {
+		conn, err = dialTLSConn(pt, ctx, trace, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+	return pt.Transport.NewClientConn(conn)
+}
+
+// dialH2CConn dials a cleartext connection for h2c (HTTP/2 over
+// cleartext TCP) requests, bypassing the TLS/ALPN path entirely.
+func dialH2CConn(pt *Transport, ctx context.Context, trace *httptrace.ClientTrace, addr string) (net.Conn, error) {
+	dial := pt.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("tcp", addr)
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("tcp", addr, err)
+	}
+	return conn, err
+}
+
+// dialTLSConn dials and TLS-handshakes a connection for "https" requests,
+// verifying the negotiated ALPN protocol is h2.
+func dialTLSConn(pt *Transport, ctx context.Context, trace *httptrace.ClientTrace, addr string) (net.Conn, error) {
+	t := pt.Transport
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	var conn net.Conn
+	cfg := newTLSConfig(t, host)
 	if t.DialTLS != nil {
-		conn, err = t.DialTLS("tcp", addr, newTLSConfig(t, host))
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		tlsConn, err := dialTLSWithContext(ctx, "tcp", addr, newTLSConfig(t, host))
-		if err != nil {
-			return nil, err
-		}
-		state := tlsConn.ConnectionState()
-		if state.NegotiatedProtocol != NextProtoTLS {
-			return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", state.NegotiatedProtocol, NextProtoTLS)
-		}
-		conn = tlsConn
+		return t.DialTLS("tcp", addr, cfg)
 	}
-	return t.NewClientConn(conn)
+	tlsConn, err := dialTLSWithContext(ctx, trace, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if state.NegotiatedProtocol != NextProtoTLS {
+		return nil, fmt.Errorf("http2: unexpected ALPN protocol %q; want %q", state.NegotiatedProtocol, NextProtoTLS)
+	}
+	return tlsConn, nil
 }
 
 func newTLSConfig(t *http2.Transport, host string) *tls.Config {
@@ -182,14 +609,27 @@ func newTLSConfig(t *http2.Transport, host string) *tls.Config {
 	return &cfg
 }
 
-func dialTLSWithContext(ctx context.Context, network string, addr string, cfg *tls.Config) (*tls.Conn, error) {
+func dialTLSWithContext(ctx context.Context, trace *httptrace.ClientTrace, network string, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, addr)
+	}
 	d := tls.Dialer{Config: cfg}
 	conn, err := d.DialContext(ctx, network, addr)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(network, addr, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 	tlsConn := conn.(*tls.Conn)
-	if err := tlsConn.Handshake(); err != nil {
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsConn.Handshake()
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
 		return nil, err
 	}
 	if cfg.InsecureSkipVerify {
@@ -1,10 +1,12 @@
 package http2_test
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 )
 
 const SrvAddr = "127.0.0.1:8888"
+const SatSrvAddr = "127.0.0.1:8889"
 
 var stdClient = http.Client{
 	Transport: &http2.Transport{
@@ -40,11 +43,38 @@ var customClient = http.Client{
 	},
 }
 
+var customH2CClient = http.Client{
+	Transport: &chttp2.Transport{
+		MaxConnsPerHost: 10,
+		IdleConnTimeout: 3 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 1 * time.Second}
+			return d.DialContext(ctx, network, addr)
+		},
+	},
+}
+
+var satClient = http.Client{
+	Transport: &chttp2.Transport{
+		MaxConnsPerHost: 1,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := net.Dialer{Timeout: 1 * time.Second}
+			return d.Dial(network, addr)
+		},
+	},
+}
+
 func handle(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, "OK")
 }
 
+func slowHandle(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(150 * time.Millisecond)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "OK")
+}
+
 func initServer() {
 	srv := http.Server{
 		Addr:    SrvAddr,
@@ -55,8 +85,22 @@ func initServer() {
 	}
 }
 
+// initSatServer runs a server that only allows 2 concurrent streams per
+// connection, so a client with MaxConnsPerHost: 1 is forced to saturate
+// its single connection when several requests run at once.
+func initSatServer() {
+	srv := http.Server{
+		Addr:    SatSrvAddr,
+		Handler: h2c.NewHandler(http.HandlerFunc(slowHandle), &http2.Server{MaxConcurrentStreams: 2}),
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		panic(err)
+	}
+}
+
 func init() {
 	go initServer()
+	go initSatServer()
 }
 
 func Test1(t *testing.T) {
@@ -72,6 +116,148 @@ func Test1(t *testing.T) {
 	t.Log(string(b))
 }
 
+func Test2(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+SrvAddr, nil)
+	resp, err := customH2CClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(string(b))
+}
+
+// Test3 forces MaxConnsPerHost: 1 against a server capped at 2 concurrent
+// streams, so once a few requests are in flight the single connection is
+// both at capacity and saturated. Every request must still succeed by
+// waiting for capacity to free up, rather than failing immediately with a
+// spurious "no available connection" error.
+func Test3(t *testing.T) {
+	const n = 6
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "https://"+SatSrvAddr, nil)
+			resp, err := satClient.Do(req)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			errCh <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+}
+
+// Test4 checks that a connection isn't reaped until IdleConnTimeout after
+// it actually goes idle (i.e. after its request completes), not
+// IdleConnTimeout after it was merely handed out.
+func Test4(t *testing.T) {
+	tr := &chttp2.Transport{
+		IdleConnTimeout: 100 * time.Millisecond,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := net.Dialer{Timeout: 1 * time.Second}
+			return d.Dial(network, addr)
+		},
+	}
+	cli := http.Client{Transport: tr}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+SrvAddr, nil)
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if hs := tr.Stats()[SrvAddr]; hs.ConnsOpen != 1 {
+		t.Fatalf("ConnsOpen = %d, want 1 right after the request completes", hs.ConnsOpen)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	if hs := tr.Stats()[SrvAddr]; hs.ConnsOpen != 0 {
+		t.Fatalf("ConnsOpen = %d, want 0 once IdleConnTimeout has elapsed since the connection went idle", hs.ConnsOpen)
+	}
+}
+
+// Test5 checks that PickConn overrides the default least-loaded selection
+// policy. The first request dials the only connection; the second finds
+// that connection already in the group, so PickConn must be consulted for
+// it.
+func Test5(t *testing.T) {
+	var picked int32
+	tr := &chttp2.Transport{
+		MaxConnsPerHost: 10,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := net.Dialer{Timeout: 1 * time.Second}
+			return d.Dial(network, addr)
+		},
+		PickConn: func(conns []*http2.ClientConn, req *http.Request) *http2.ClientConn {
+			atomic.AddInt32(&picked, 1)
+			return conns[0]
+		},
+	}
+	cli := http.Client{Transport: tr}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+SrvAddr, nil)
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if atomic.LoadInt32(&picked) == 0 {
+		t.Fatal("PickConn was never invoked")
+	}
+}
+
+// Test6 is a sanity check on Stats(): after a successful request, the
+// returned snapshot must carry an entry for the request's host with a
+// plausible connection/stream count and no reported errors or retries.
+func Test6(t *testing.T) {
+	tr := &chttp2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := net.Dialer{Timeout: 1 * time.Second}
+			return d.Dial(network, addr)
+		},
+	}
+	cli := http.Client{Transport: tr}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+SrvAddr, nil)
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	hs, ok := tr.Stats()[SrvAddr]
+	if !ok {
+		t.Fatalf("Stats() has no entry for %s", SrvAddr)
+	}
+	if hs.ConnsOpen != 1 {
+		t.Fatalf("ConnsOpen = %d, want 1", hs.ConnsOpen)
+	}
+	if hs.DialErrors != 0 || hs.Retries != 0 || hs.ConnsDead != 0 {
+		t.Fatalf("got DialErrors=%d Retries=%d ConnsDead=%d, want all 0", hs.DialErrors, hs.Retries, hs.ConnsDead)
+	}
+}
+
 func doRequest(cli *http.Client) error {
 	req, _ := http.NewRequest(http.MethodGet, "https://"+SrvAddr, nil)
 	resp, err := cli.Do(req)
@@ -0,0 +1,88 @@
+package http2
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func newTestTransport(maxRetries int) *Transport {
+	tr := &Transport{MaxRetries: maxRetries}
+	tr.initlOnce.Do(tr.init)
+	return tr
+}
+
+func TestRoundTripRetriesRetryableError(t *testing.T) {
+	tr := newTestTransport(1)
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	attempts := 0
+	resp, err := tr.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, http2.GoAwayError{ErrCode: http2.ErrCodeNo}
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	if err != nil {
+		t.Fatalf("roundTrip() err = %v, want nil", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resp.StatusCode = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2 (initial attempt + 1 retry)", attempts)
+	}
+}
+
+func TestRoundTripRespectsMaxRetries(t *testing.T) {
+	tr := newTestTransport(1)
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	attempts := 0
+	_, err := tr.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, http2.GoAwayError{ErrCode: http2.ErrCodeNo}
+	})
+	if err == nil {
+		t.Fatal("roundTrip() err = nil, want non-nil after exhausting retries")
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2 (initial attempt + MaxRetries=1)", attempts)
+	}
+}
+
+func TestRoundTripSkipsNonIdempotentMethod(t *testing.T) {
+	tr := newTestTransport(1)
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com", nil)
+
+	attempts := 0
+	_, err := tr.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, http2.GoAwayError{ErrCode: http2.ErrCodeNo}
+	})
+	if err == nil {
+		t.Fatal("roundTrip() err = nil, want non-nil")
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1 (POST must not be retried)", attempts)
+	}
+}
+
+func TestRoundTripSkipsAbnormalGoAway(t *testing.T) {
+	tr := newTestTransport(1)
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+
+	attempts := 0
+	_, err := tr.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, http2.GoAwayError{ErrCode: http2.ErrCodeInternal}
+	})
+	if err == nil {
+		t.Fatal("roundTrip() err = nil, want non-nil")
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1 (non-NO_ERROR GOAWAY must not be retried)", attempts)
+	}
+}
@@ -1,10 +1,13 @@
 package http2
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -24,6 +27,16 @@ type Transport struct {
 	// it will be used to set http.Response.TLS.
 	DialTLS func(network, addr string, cfg *tls.Config) (net.Conn, error)
 
+	// DialContext specifies an optional dial function for creating
+	// cleartext connections for "http" requests, enabling h2c
+	// (HTTP/2 over cleartext TCP) support. Setting DialContext implies
+	// AllowHTTP, since there would otherwise be no way to use it.
+	//
+	// If DialContext is nil, "http" requests (permitted only with
+	// AllowHTTP) are dialed in cleartext with a plain net.Dialer; DialTLS
+	// is used only for "https" requests.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
@@ -39,7 +52,8 @@ type Transport struct {
 	DisableCompression bool
 
 	// AllowHTTP, if true, permits HTTP/2 requests using the insecure,
-	// plain-text "http" scheme. Note that this does not enable h2c support.
+	// plain-text "http" scheme. Such requests are dialed in cleartext
+	// (h2c), through DialContext if set or a plain net.Dialer otherwise.
 	AllowHTTP bool
 
 	// MaxHeaderListSize is the http2 SETTINGS_MAX_HEADER_LIST_SIZE to
@@ -120,6 +134,56 @@ type Transport struct {
 	// This time does not include the time to send the request header.
 	ExpectContinueTimeout time.Duration
 
+	// MaxRetries optionally limits the number of times an idempotent
+	// request is retried on a fresh connection after a retryable error
+	// (a NO_ERROR GOAWAY, a refused stream, or no cached connection
+	// available). A GOAWAY with any other error code is not retried.
+	// The request's body must be nil or rewindable via GetBody.
+	//
+	// Zero means no retries.
+	MaxRetries int
+
+	// RetryPolicy, if non-nil, is consulted after a retryable error to
+	// decide whether attempt (starting at 0) should be retried. If nil,
+	// all retryable errors are retried up to MaxRetries.
+	RetryPolicy func(req *http.Request, err error, attempt int) bool
+
+	// HighWaterMarkRatio is the fraction of a connection's
+	// SETTINGS_MAX_CONCURRENT_STREAMS above which it is considered
+	// saturated. When every connection in a host's pool is saturated, a
+	// new connection is dialed even if MaxConnsPerHost has not yet been
+	// reached.
+	//
+	// Zero means a default of 0.8.
+	HighWaterMarkRatio float64
+
+	// PickConn, if non-nil, selects which connection among conns (all of
+	// which can currently take a new request) should serve req,
+	// overriding the default least-loaded selection policy. It returning
+	// nil falls back to the default policy.
+	PickConn func(conns []*http2.ClientConn, req *http.Request) *http2.ClientConn
+
+	// OnDialStart, if non-nil, is called before the Transport dials a new
+	// connection to addr.
+	OnDialStart func(addr string)
+
+	// OnDialDone, if non-nil, is called after a dial to addr completes.
+	// err is non-nil on failure.
+	OnDialDone func(addr string, err error)
+
+	// OnConnAcquired, if non-nil, is called each time a connection is
+	// handed out of the pool to serve a request.
+	OnConnAcquired func(addr string, conn *http2.ClientConn)
+
+	// OnConnReleased, if non-nil, is called once a request finishes with
+	// the connection it was handed, whether it succeeded or failed. It is
+	// not called if that connection has already been removed from the pool.
+	OnConnReleased func(addr string, conn *http2.ClientConn)
+
+	// OnConnMarkedDead, if non-nil, is called when a connection is
+	// removed from the pool after being marked dead.
+	OnConnMarkedDead func(addr string, conn *http2.ClientConn)
+
 	*http2.Transport
 
 	initlOnce sync.Once
@@ -128,12 +192,96 @@ type Transport struct {
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	t.initlOnce.Do(t.init)
-	return t.Transport.RoundTrip(req)
+	return t.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		return t.Transport.RoundTrip(req)
+	})
 }
 
 func (t *Transport) RoundTripOpt(req *http.Request, opt http2.RoundTripOpt) (*http.Response, error) {
 	t.initlOnce.Do(t.init)
-	return t.Transport.RoundTripOpt(req, opt)
+	return t.roundTrip(req, func(req *http.Request) (*http.Response, error) {
+		return t.Transport.RoundTripOpt(req, opt)
+	})
+}
+
+// roundTrip wraps rt with the retry-on-fresh-conn policy described by
+// MaxRetries/RetryPolicy. A failed attempt only quarantines the connection
+// it used when the failure is a genuinely connection-level one (see
+// isRetryableError) — a canceled context, a response-header timeout, or an
+// ordinary failure on a non-idempotent request leaves the connection
+// perfectly healthy for other callers, so those releases are treated like
+// a success.
+func (t *Transport) roundTrip(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	retry := isIdempotent(req) && canRetryRequest(req)
+	for attempt := 0; ; attempt++ {
+		resp, err := rt(req)
+		if err == nil {
+			t.connPool.forget(req)
+			return resp, nil
+		}
+		retryableErr := isRetryableError(err)
+		if retryableErr {
+			t.connPool.quarantine(req)
+		} else {
+			t.connPool.forget(req)
+		}
+		if !retry || attempt >= t.MaxRetries || !retryableErr {
+			return resp, err
+		}
+		policy := t.RetryPolicy
+		if policy != nil && !policy(req, err, attempt) {
+			return resp, err
+		}
+		if req.GetBody != nil {
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+		t.connPool.incrRetry(canonicalAddr(req))
+	}
+}
+
+// isIdempotent reports whether req's method is safe to resend to a
+// different connection without risking a duplicate side effect on the
+// server. Unlike net/http's Request.isReplayable method gate, it also
+// accepts PUT and DELETE, and it ignores Idempotency-Key headers.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// canRetryRequest reports whether req's body can be replayed on a retry.
+func canRetryRequest(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isRetryableError reports whether err is a transient, connection-level
+// failure that is safe to retry on a different *http2.ClientConn.
+//
+// For a GoAwayError, "safe" additionally requires ErrCode == ErrCodeNo: a
+// NO_ERROR GOAWAY is the server announcing a graceful shutdown before it
+// stops accepting new streams, so no in-flight request on that connection
+// can have reached the server as a new, possibly-processed stream. Any
+// other GOAWAY code signals an abnormal condition, and http2.ClientConn
+// does not expose the stream ID a given request was assigned, so we have
+// no way to compare it against GoAwayError.LastStreamID to tell whether
+// the request was already seen by the peer; treat those as unsafe.
+func isRetryableError(err error) bool {
+	if err == http2.ErrNoCachedConn {
+		return true
+	}
+	if ge, ok := err.(http2.GoAwayError); ok {
+		return ge.ErrCode == http2.ErrCodeNo
+	}
+	if se, ok := err.(http2.StreamError); ok && se.Code == http2.ErrCodeRefusedStream {
+		return true
+	}
+	return false
 }
 
 func (t *Transport) init() {
@@ -147,17 +295,91 @@ func (t *Transport) init() {
 	t2.DialTLS = t.DialTLS
 	t2.TLSClientConfig = t.TLSClientConfig
 	t2.DisableCompression = t.DisableCompression
-	t2.AllowHTTP = t.AllowHTTP
+	t2.AllowHTTP = t.AllowHTTP || t.DialContext != nil
 	t2.MaxHeaderListSize = t.MaxHeaderListSize
 	t2.StrictMaxConcurrentStreams = t.StrictMaxConcurrentStreams
 	t2.ReadIdleTimeout = t.ReadIdleTimeout
 	t2.PingTimeout = t.PingTimeout
 	t2.CountError = t.CountError
-	t2.ConnPool = &clientConnPool{
+	pool := &clientConnPool{
 		t:               t,
 		groups:          make(map[string]*clientConnGroup),
 		keys:            make(map[*http2.ClientConn]string),
 		maxConnsPerHost: t.MaxConnsPerHost,
 	}
+	t2.ConnPool = pool
+	t.connPool = pool
 	t.Transport = t2
 }
+
+// CloseIdleConnections closes any connections which were previously
+// connected from previous requests but are now sitting idle, i.e. with
+// no active streams. It does not interrupt any connections currently in
+// use, matching http.Transport's contract.
+func (t *Transport) CloseIdleConnections() {
+	t.initlOnce.Do(t.init)
+	t.connPool.closeIdleConnections()
+}
+
+// HostStats is a point-in-time snapshot of connection and retry counters
+// for a single "host:port" address.
+type HostStats struct {
+	ConnsOpen     int
+	ConnsDialing  int
+	ConnsDead     int64
+	StreamsActive int
+	DialErrors    int64
+	Retries       int64
+	WaitTimes     WaitTimeHistogram
+}
+
+// WaitTimeHistogram buckets how long RoundTrip callers waited for a
+// connection to become available.
+type WaitTimeHistogram struct {
+	Under1ms   int64
+	Under10ms  int64
+	Under100ms int64
+	Under1s    int64
+	Over1s     int64
+}
+
+func (h *WaitTimeHistogram) observe(d time.Duration) {
+	switch {
+	case d < time.Millisecond:
+		atomic.AddInt64(&h.Under1ms, 1)
+	case d < 10*time.Millisecond:
+		atomic.AddInt64(&h.Under10ms, 1)
+	case d < 100*time.Millisecond:
+		atomic.AddInt64(&h.Under100ms, 1)
+	case d < time.Second:
+		atomic.AddInt64(&h.Under1s, 1)
+	default:
+		atomic.AddInt64(&h.Over1s, 1)
+	}
+}
+
+// Stats returns a point-in-time snapshot of per-address connection and
+// retry counters, suitable for wiring into an expvar or Prometheus/
+// OpenTelemetry metric without patching the pool.
+func (t *Transport) Stats() map[string]HostStats {
+	t.initlOnce.Do(t.init)
+	return t.connPool.stats()
+}
+
+// canonicalAddr returns req's "host:port", defaulting the port from its
+// scheme, matching the addr the connection pool groups connections by.
+func canonicalAddr(req *http.Request) string {
+	addr := req.URL.Host
+	if !hasPort(addr) {
+		if req.URL.Scheme == "https" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+	return addr
+}
+
+func hasPort(addr string) bool {
+	return strings.LastIndexByte(addr, ':') > strings.LastIndexByte(addr, ']')
+}